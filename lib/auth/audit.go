@@ -0,0 +1,178 @@
+/*
+Copyright 2015 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package auth
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/gravitational/trace"
+)
+
+// Audit event types emitted by AuthServer. Field values are free-form
+// and vary by type; see the call sites in auth.go for what each one
+// carries.
+const (
+	AuditEventSignIn          = "user.login"
+	AuditEventWebSessionStart = "session.web.start"
+	AuditEventNodeJoin        = "node.join"
+	AuditEventAuthServerJoin  = "auth.join"
+	AuditEventHostCertIssued  = "cert.host.issued"
+	AuditEventUserCertIssued  = "cert.user.issued"
+	AuditEventTokenDeleted    = "token.deleted"
+)
+
+// AuditEvent is a single entry in the audit log's hash chain.
+type AuditEvent struct {
+	// Seq is this event's position in the chain, starting at 0
+	Seq int64 `json:"seq"`
+	// PrevHash is the Hash of the event immediately before this one, or
+	// the empty string for the first event in a shard
+	PrevHash string `json:"prev_hash"`
+	// Hash is SHA256(PrevHash || canonical_json(event with Hash unset))
+	Hash string `json:"hash"`
+	// Timestamp is when the event was emitted
+	Timestamp time.Time `json:"timestamp"`
+	// Type is one of the AuditEvent* constants
+	Type string `json:"type"`
+	// Actor identifies who or what triggered the event, e.g. a
+	// username or a node name
+	Actor string `json:"actor"`
+	// Fields carries event-specific details
+	Fields map[string]interface{} `json:"fields,omitempty"`
+}
+
+// AuditLogCheckpoint is a periodic, signed pin of the chain's current
+// head, so external auditors can verify nothing was rewritten since it
+// was issued.
+type AuditLogCheckpoint struct {
+	// Seq is the Seq of the event this checkpoint pins
+	Seq int64 `json:"seq"`
+	// Hash is the Hash of the event this checkpoint pins
+	Hash string `json:"hash"`
+	// Signature is the host CA active signing key's signature over Seq
+	// and Hash
+	Signature []byte `json:"signature"`
+}
+
+// AuditLog records a tamper-evident, append-only stream of events. Each
+// event's Hash commits to the previous event's Hash, so altering or
+// removing an event invalidates every hash after it.
+type AuditLog interface {
+	// EmitAuditEvent appends an event to the chain, filling in Seq,
+	// PrevHash, Hash and Timestamp, and returns the stored event so
+	// callers can pin a checkpoint to its Seq/Hash without a second read
+	EmitAuditEvent(eventType, actor string, fields map[string]interface{}) (AuditEvent, error)
+
+	// SearchEvents returns events between from and to (inclusive) whose
+	// Type matches filter (empty matches all types), up to limit events
+	SearchEvents(from, to time.Time, filter string, limit int) ([]AuditEvent, error)
+
+	// VerifyAuditChain re-walks the chain from its first event through
+	// to and returns the Seq of the first event that breaks it, either
+	// because its Hash no longer matches
+	// SHA256(PrevHash || canonical_json(event)) or because its PrevHash
+	// no longer matches the Hash of the event immediately before it
+	// (which is what catches a deleted or reordered event in the middle
+	// of the chain, not just a tampered one). Returns -1 if the chain is
+	// intact. The walk always starts at the chain's first event
+	// regardless of from, since a break earlier than from would
+	// otherwise go undetected; from is accepted for interface symmetry
+	// with SearchEvents but does not bound the walk.
+	VerifyAuditChain(from, to time.Time) (int64, error)
+}
+
+// hashEvent computes the chain hash for evt given the previous event's
+// hash: SHA256(prevHash || canonical_json(evt)) with evt.Hash cleared
+// first so the hash never covers itself.
+func hashEvent(prevHash string, evt AuditEvent) (string, error) {
+	evt.Hash = ""
+	canonical, err := canonicalJSON(evt)
+	if err != nil {
+		return "", trace.Wrap(err)
+	}
+	sum := sha256.Sum256(append([]byte(prevHash), canonical...))
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// canonicalJSON marshals v with sorted map keys so the same event
+// always hashes to the same bytes regardless of field iteration order.
+// encoding/json already sorts map[string]interface{} keys, so a plain
+// Marshal is canonical as long as every map in v is of that type, which
+// is true for AuditEvent.Fields.
+func canonicalJSON(v interface{}) ([]byte, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	return data, nil
+}
+
+// EmitAuditEvent records evt to the configured AuditLog backend, if
+// one is set. AuthServer call sites treat a missing backend as a no-op
+// so that running without an audit log configured doesn't break auth
+// flows, but log it at warn level so the gap is visible operationally.
+func (s *AuthServer) EmitAuditEvent(eventType, actor string, fields map[string]interface{}) error {
+	if s.auditLog == nil {
+		log.Warningf("[AUTH] audit event %v dropped: no audit log configured", eventType)
+		return nil
+	}
+	evt, err := s.auditLog.EmitAuditEvent(eventType, actor, fields)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	if err := s.maybeCheckpoint(evt.Seq, evt.Hash); err != nil {
+		log.Warningf("[AUTH] failed to checkpoint audit chain at seq %v: %v", evt.Seq, err)
+	}
+	return nil
+}
+
+// SearchEvents queries the configured AuditLog backend.
+func (s *AuthServer) SearchEvents(from, to time.Time, filter string, limit int) ([]AuditEvent, error) {
+	if s.auditLog == nil {
+		return nil, trace.NotFound("no audit log configured")
+	}
+	events, err := s.auditLog.SearchEvents(from, to, filter, limit)
+	return events, trace.Wrap(err)
+}
+
+// VerifyAuditChain re-validates the hash chain from its first event
+// through to; from does not bound the walk (see AuditLog).
+func (s *AuthServer) VerifyAuditChain(from, to time.Time) (int64, error) {
+	if s.auditLog == nil {
+		return -1, trace.NotFound("no audit log configured")
+	}
+	seq, err := s.auditLog.VerifyAuditChain(from, to)
+	return seq, trace.Wrap(err)
+}
+
+// SetAuditLog wires backend in as the AuditLog used by EmitAuditEvent.
+// Passing nil disables auditing.
+func (s *AuthServer) SetAuditLog(backend AuditLog) {
+	s.auditLog = backend
+}
+
+// emitAudit is the call-site helper used throughout auth.go: auditing is
+// best-effort, so a failure to record an event is logged rather than
+// failing the auth flow that triggered it.
+func (s *AuthServer) emitAudit(eventType, actor string, fields map[string]interface{}) {
+	if err := s.EmitAuditEvent(eventType, actor, fields); err != nil {
+		log.Warningf("[AUTH] failed to emit audit event %v: %v", eventType, err)
+	}
+}
@@ -24,8 +24,6 @@ package auth
 
 import (
 	"fmt"
-
-	"os"
 	"time"
 
 	"github.com/gravitational/configure/cstrings"
@@ -78,6 +76,17 @@ func AuthClock(clock clockwork.Clock) AuthServerOption {
 	}
 }
 
+// AuthLicense configures the signed license AuthServer loads and
+// enforces at startup. Invalid license data logs a warning rather than
+// failing NewAuthServer; the server then comes up unlicensed, same as
+// if no license were configured at all (see license.go for what that
+// allows and denies).
+func AuthLicense(pem []byte) AuthServerOption {
+	return func(a *AuthServer) {
+		a.licensePEM = pem
+	}
+}
+
 // NewAuthServer returns a new AuthServer instance
 func NewAuthServer(bk *encryptedbk.ReplicatedBackend, a Authority, hostname string, opts ...AuthServerOption) *AuthServer {
 	as := AuthServer{}
@@ -99,8 +108,15 @@ func NewAuthServer(bk *encryptedbk.ReplicatedBackend, a Authority, hostname stri
 	as.ProvisioningService = services.NewProvisioningService(as.bk)
 	as.WebService = services.NewWebService(as.bk)
 	as.BkKeysService = services.NewBkKeysService(as.bk)
+	as.OIDCService = services.NewOIDCService(as.bk)
 
 	as.Hostname = hostname
+	as.provisioners = defaultProvisioners()
+	if len(as.licensePEM) > 0 {
+		if err := as.LoadLicense(as.licensePEM); err != nil {
+			log.Warningf("[AUTH] failed to load license, starting unlicensed: %v", err)
+		}
+	}
 	return &as
 }
 
@@ -118,6 +134,23 @@ type AuthServer struct {
 	*services.ProvisioningService
 	*services.WebService
 	*services.BkKeysService
+	*services.OIDCService
+
+	// provisioners holds the join-flow handlers keyed by identity
+	// document kind ("token", "gcp", "aws", "azure"); see provisioner.go
+	provisioners map[string]Provisioner
+
+	// auditLog receives a tamper-evident record of security-relevant
+	// events; nil disables auditing. See audit.go and SetAuditLog.
+	auditLog AuditLog
+
+	// licensePEM is the raw license data passed via AuthLicense, loaded
+	// once NewAuthServer finishes constructing as. See license.go.
+	licensePEM []byte
+	// license holds the parsed, currently enforced license; no parsed
+	// license means unlicensed: limits are not enforced, but
+	// feature-gated calls (OIDC, cloud join) are denied. See license.go.
+	license licenseState
 }
 
 // GetLocalDomain returns domain name that identifies this authority server
@@ -137,11 +170,16 @@ func (s *AuthServer) GenerateHostCert(
 	if err != nil {
 		return nil, trace.Wrap(err)
 	}
-	privateKey, err := ca.FirstSigningKey()
+	privateKey, err := ca.ActiveSigningKey()
 	if err != nil {
 		return nil, trace.Wrap(err)
 	}
-	return s.Authority.GenerateHostCert(privateKey, key, hostname, authDomain, role, ttl)
+	cert, err := s.Authority.GenerateHostCert(privateKey, key, hostname, authDomain, role, ttl)
+	if err != nil {
+		return nil, err
+	}
+	s.emitAudit(AuditEventHostCertIssued, hostname, map[string]interface{}{"role": role})
+	return cert, nil
 }
 
 // GenerateUserCert generates user certificate, it takes pkey as a signing
@@ -156,17 +194,28 @@ func (s *AuthServer) GenerateUserCert(
 	if err != nil {
 		return nil, trace.Wrap(err)
 	}
-	privateKey, err := ca.FirstSigningKey()
+	privateKey, err := ca.ActiveSigningKey()
 	if err != nil {
 		return nil, trace.Wrap(err)
 	}
-	return s.Authority.GenerateUserCert(privateKey, key, username, ttl)
+	cert, err := s.Authority.GenerateUserCert(privateKey, key, username, ttl)
+	if err != nil {
+		return nil, err
+	}
+	s.emitAudit(AuditEventUserCertIssued, username, nil)
+	return cert, nil
 }
 
 func (s *AuthServer) SignIn(user string, password []byte) (*Session, error) {
+	if err := s.checkLicenseTime(); err != nil {
+		return nil, trace.Wrap(err)
+	}
 	if err := s.CheckPasswordWOToken(user, password); err != nil {
 		return nil, trace.Wrap(err)
 	}
+	if err := s.checkMaxUsers(); err != nil {
+		return nil, trace.Wrap(err)
+	}
 	sess, err := s.NewWebSession(user)
 	if err != nil {
 		return nil, trace.Wrap(err)
@@ -175,16 +224,27 @@ func (s *AuthServer) SignIn(user string, password []byte) (*Session, error) {
 		return nil, trace.Wrap(err)
 	}
 	sess.WS.Priv = nil
+	s.emitAudit(AuditEventSignIn, user, nil)
 	return sess, nil
 }
 
 // CreateWebSession creates a new web session for a user based on a valid previous sessionID,
 // method is used to renew the web session for a user
 func (s *AuthServer) CreateWebSession(user string, prevSessionID string) (*Session, error) {
+	// renewing an existing session keeps working through the license's
+	// grace period, unlike SignIn which stops at NotAfter
+	if lic := s.license.get(); lic != nil {
+		if err := lic.CheckTime(s.clock.Now().UTC(), licenseExpiryGrace); err != nil {
+			return nil, trace.Wrap(err)
+		}
+	}
 	_, err := s.GetWebSession(user, prevSessionID)
 	if err != nil {
 		return nil, trace.Wrap(err)
 	}
+	if err := s.checkMaxUsers(); err != nil {
+		return nil, trace.Wrap(err)
+	}
 	sess, err := s.NewWebSession(user)
 	if err != nil {
 		return nil, trace.Wrap(err)
@@ -193,6 +253,7 @@ func (s *AuthServer) CreateWebSession(user string, prevSessionID string) (*Sessi
 		return nil, trace.Wrap(err)
 	}
 	sess.WS.Priv = nil
+	s.emitAudit(AuditEventWebSessionStart, user, nil)
 	return sess, nil
 }
 
@@ -238,6 +299,9 @@ func (s *AuthServer) RegisterUsingToken(outputToken, nodename string, role telep
 	if err := role.Check(); err != nil {
 		return PackedKeys{}, trace.Wrap(err)
 	}
+	if err := s.checkMaxNodes(); err != nil {
+		return PackedKeys{}, trace.Wrap(err)
+	}
 	token, _, err := services.SplitTokenRole(outputToken)
 	if err != nil {
 		return PackedKeys{}, trace.Wrap(err)
@@ -256,30 +320,18 @@ func (s *AuthServer) RegisterUsingToken(outputToken, nodename string, role telep
 		return PackedKeys{}, trace.Wrap(
 			teleport.BadParameter("token.Role", "role does not match"))
 	}
-	k, pub, err := s.GenerateKeyPair("")
-	if err != nil {
-		return PackedKeys{}, trace.Wrap(err)
-	}
-	// we always append authority's domain to resulting node name,
-	// that's how we make sure that nodes are uniquely identified/found
-	// in cases when we have multiple environments/organizations
-	fqdn := fmt.Sprintf("%s.%s", nodename, s.Hostname)
-	c, err := s.GenerateHostCert(pub, fqdn, s.Hostname, role, 0)
+
+	keys, err = s.issueHostCert(nodename, role)
 	if err != nil {
 		log.Warningf("[AUTH] Node `%v` cannot join: cert generation error. %v", nodename, err)
 		return PackedKeys{}, trace.Wrap(err)
 	}
 
-	keys = PackedKeys{
-		Key:  k,
-		Cert: c,
-	}
-
 	if err := s.DeleteToken(outputToken); err != nil {
 		return PackedKeys{}, trace.Wrap(err)
 	}
 
-	utils.Consolef(os.Stdout, "[AUTH] Node `%v` joined the cluster", nodename)
+	s.emitAudit(AuditEventNodeJoin, nodename, map[string]interface{}{"role": role})
 	return keys, nil
 }
 
@@ -318,6 +370,7 @@ func (s *AuthServer) RegisterNewAuthServer(domainName, outputToken string,
 		return encryptor.Key{}, trace.Wrap(err)
 	}
 
+	s.emitAudit(AuditEventAuthServerJoin, domainName, nil)
 	return localKey.Public(), nil
 }
 
@@ -326,7 +379,11 @@ func (s *AuthServer) DeleteToken(outputToken string) error {
 	if err != nil {
 		return err
 	}
-	return s.ProvisioningService.DeleteToken(token)
+	if err := s.ProvisioningService.DeleteToken(token); err != nil {
+		return err
+	}
+	s.emitAudit(AuditEventTokenDeleted, token, nil)
+	return nil
 }
 
 func (s *AuthServer) NewWebSession(userName string) (*Session, error) {
@@ -349,7 +406,7 @@ func (s *AuthServer) NewWebSession(userName string) (*Session, error) {
 	if err != nil {
 		return nil, trace.Wrap(err)
 	}
-	privateKey, err := ca.FirstSigningKey()
+	privateKey, err := ca.ActiveSigningKey()
 	if err != nil {
 		return nil, trace.Wrap(err)
 	}
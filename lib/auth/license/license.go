@@ -0,0 +1,111 @@
+/*
+Copyright 2015 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+// package license parses and verifies the signed license AuthServer
+// loads at startup, and answers feature/limit questions against it.
+package license
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/json"
+	"time"
+
+	"github.com/gravitational/trace"
+)
+
+// publicKey is the Ed25519 key license signatures are verified against.
+// It is swapped at build time for the real production key.
+var publicKey = ed25519.PublicKey(make([]byte, ed25519.PublicKeySize))
+
+// Features lists the add-on capabilities a license may enable.
+type Features struct {
+	OIDC             bool `json:"oidc"`
+	CloudJoin        bool `json:"cloud_join"`
+	SessionRecording bool `json:"session_recording"`
+}
+
+// Limits caps resource counts a license allows.
+type Limits struct {
+	MaxNodes int `json:"max_nodes"`
+	MaxUsers int `json:"max_users"`
+}
+
+// Payload is the signed body of a license.
+type Payload struct {
+	Customer string    `json:"customer"`
+	IssuedAt time.Time `json:"issued_at"`
+	NotBefore time.Time `json:"not_before"`
+	NotAfter  time.Time `json:"not_after"`
+	Features  Features  `json:"features"`
+	Limits    Limits    `json:"limits"`
+}
+
+// License is a Payload plus the detached Ed25519 signature over its
+// canonical JSON encoding.
+type License struct {
+	Payload   Payload `json:"payload"`
+	Signature []byte  `json:"signature"`
+}
+
+// Parse verifies raw's signature against the embedded public key and
+// returns its payload. raw is a JSON document of the form
+// {"payload": {...}, "signature": "<base64>"} rather than a PEM file,
+// despite the pem parameter name used by LoadLicense/ReloadLicense.
+func Parse(raw []byte) (*Payload, error) {
+	var lic License
+	if err := json.Unmarshal(raw, &lic); err != nil {
+		return nil, trace.Wrap(err)
+	}
+	canonical, err := json.Marshal(lic.Payload)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	if !ed25519.Verify(publicKey, canonical, lic.Signature) {
+		return nil, trace.AccessDenied("license signature verification failed")
+	}
+	return &lic.Payload, nil
+}
+
+// CheckTime returns an error if now falls outside [NotBefore, NotAfter],
+// with grace extending acceptance of an expired license by grace.
+func (p *Payload) CheckTime(now time.Time, grace time.Duration) error {
+	if now.Before(p.NotBefore) {
+		return trace.AccessDenied("license is not valid until %v", p.NotBefore)
+	}
+	if now.After(p.NotAfter.Add(grace)) {
+		return trace.AccessDenied("license expired on %v", p.NotAfter)
+	}
+	return nil
+}
+
+// ExpiresSoon reports whether NotAfter is within warnWithin of now.
+func (p *Payload) ExpiresSoon(now time.Time, warnWithin time.Duration) bool {
+	return now.Add(warnWithin).After(p.NotAfter)
+}
+
+// Equal reports whether two payloads were parsed from the same license,
+// used by AuthServer.ReloadLicense to skip redundant reloads.
+func (p *Payload) Equal(other *Payload) bool {
+	if other == nil {
+		return false
+	}
+	a, errA := json.Marshal(p)
+	b, errB := json.Marshal(other)
+	if errA != nil || errB != nil {
+		return false
+	}
+	return bytes.Equal(a, b)
+}
@@ -0,0 +1,409 @@
+/*
+Copyright 2015 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package auth
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gravitational/teleport/lib/services"
+	"github.com/gravitational/teleport/lib/utils"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/gravitational/trace"
+)
+
+const (
+	// OIDCAuthRequestTTL is how long a CreateOIDCAuthRequest state token
+	// remains valid while the user completes the provider's login flow
+	OIDCAuthRequestTTL = 10 * time.Minute
+	// oidcStateLenBytes is the length in bytes of the random state value
+	oidcStateLenBytes = 32
+)
+
+// OIDCAuthRequest describes a pending OIDC login initiated by
+// CreateOIDCAuthRequest; it is persisted with a TTL so ValidateOIDCAuthCallback
+// can look it up again once the provider redirects back.
+type OIDCAuthRequest struct {
+	// ConnectorID is the name of the services.OIDCConnector this request
+	// was started against
+	ConnectorID string `json:"connector_id"`
+	// RedirectURL is the provider's authorize endpoint, with client_id,
+	// redirect_uri, state and scope already filled in
+	RedirectURL string `json:"redirect_url"`
+	// StateToken is the random value used to correlate the callback with
+	// this request and protect against CSRF
+	StateToken string `json:"state_token"`
+	// Nonce is a random value echoed back in the ID token's nonce claim,
+	// binding the token to this specific request and protecting against
+	// replay of a token obtained from an earlier login
+	Nonce string `json:"nonce"`
+}
+
+// CreateOIDCAuthRequest starts an OIDC login against connectorID: it
+// fetches (or reuses the cached copy of) the connector's discovery
+// document, mints a random state token, persists the pending request
+// under that token, and returns the provider authorize URL the caller
+// should redirect the user's browser to.
+func (s *AuthServer) CreateOIDCAuthRequest(connectorID, redirectURL string) (*OIDCAuthRequest, error) {
+	if err := s.checkFeature("oidc", s.licenseFeatures().OIDC); err != nil {
+		return nil, trace.Wrap(err)
+	}
+	connector, err := s.OIDCService.GetOIDCConnector(connectorID)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	provider, err := s.oidcProvider(connector)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	stateToken, err := utils.CryptoRandomHex(oidcStateLenBytes)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	nonce, err := utils.CryptoRandomHex(oidcStateLenBytes)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	req := OIDCAuthRequest{
+		ConnectorID: connectorID,
+		StateToken:  stateToken,
+		Nonce:       nonce,
+	}
+	if err := s.OIDCService.UpsertOIDCAuthRequest(stateToken, req, OIDCAuthRequestTTL); err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	authorizeURL, err := url.Parse(provider.AuthorizeEndpoint)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	q := authorizeURL.Query()
+	q.Set("client_id", connector.GetClientID())
+	q.Set("redirect_uri", redirectURL)
+	q.Set("response_type", "code")
+	q.Set("scope", "openid email profile groups")
+	q.Set("state", stateToken)
+	q.Set("nonce", nonce)
+	authorizeURL.RawQuery = q.Encode()
+	req.RedirectURL = authorizeURL.String()
+
+	return &req, nil
+}
+
+// ValidateOIDCAuthCallback completes an OIDC login started by
+// CreateOIDCAuthRequest: it looks up the pending request by state,
+// exchanges code for tokens, verifies the ID token, maps its claims to a
+// Teleport identity, auto-provisions the user if necessary and returns a
+// fresh web session for them.
+func (s *AuthServer) ValidateOIDCAuthCallback(code, state string) (*Session, error) {
+	req, err := s.OIDCService.GetOIDCAuthRequest(state)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	if err := s.OIDCService.DeleteOIDCAuthRequest(state); err != nil {
+		log.Warningf("[AUTH] failed to delete used OIDC auth request %v: %v", state, err)
+	}
+
+	connector, err := s.OIDCService.GetOIDCConnector(req.ConnectorID)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	provider, err := s.oidcProvider(connector)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	idToken, err := provider.exchangeCode(connector, code)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	claims, err := provider.verifyIDToken(connector.GetIssuerURL(), connector.GetClientID(), req.Nonce, idToken)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	username, err := connector.MapClaimsToUser(claims)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	if _, err := s.GetUser(username); err != nil {
+		if !trace.IsNotFound(err) {
+			return nil, trace.Wrap(err)
+		}
+		if err := s.UpsertUser(connector.NewUserFromClaims(username, claims)); err != nil {
+			return nil, trace.Wrap(err)
+		}
+	}
+
+	sess, err := s.NewWebSession(username)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	if err := s.UpsertWebSession(username, sess, WebSessionTTL); err != nil {
+		return nil, trace.Wrap(err)
+	}
+	sess.WS.Priv = nil
+	return sess, nil
+}
+
+// oidcClaims is the decoded payload of an OIDC ID token
+type oidcClaims map[string]interface{}
+
+// oidcProviders caches one oidcProvider per connector so the discovery
+// document and JWKS aren't refetched on every login
+var (
+	oidcProviders   = map[string]*oidcProvider{}
+	oidcProvidersMu sync.Mutex
+)
+
+// oidcProvider wraps a connector's cached discovery document and signing
+// keys. The discovery document is fetched once per connector and is not
+// refreshed after that; the signing keys are re-fetched only when an ID
+// token names a kid that is not in the cache.
+type oidcProvider struct {
+	AuthorizeEndpoint string
+	TokenEndpoint     string
+	JWKSURI           string
+
+	mu          sync.Mutex
+	keys        map[string]*rsa.PublicKey
+	lastRefresh time.Time
+}
+
+// oidcProvider returns the cached provider for connector, fetching and
+// caching its discovery document on first use.
+func (s *AuthServer) oidcProvider(connector services.OIDCConnector) (*oidcProvider, error) {
+	oidcProvidersMu.Lock()
+	defer oidcProvidersMu.Unlock()
+
+	p, ok := oidcProviders[connector.GetName()]
+	if ok {
+		return p, nil
+	}
+
+	p, err := fetchOIDCProvider(connector.GetIssuerURL())
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	oidcProviders[connector.GetName()] = p
+	return p, nil
+}
+
+// fetchOIDCProvider downloads issuer's discovery document.
+func fetchOIDCProvider(issuer string) (*oidcProvider, error) {
+	resp, err := http.Get(strings.TrimRight(issuer, "/") + "/.well-known/openid-configuration")
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, trace.BadParameter("unexpected status %v fetching OIDC discovery document", resp.StatusCode)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	var doc struct {
+		AuthorizeEndpoint string `json:"authorization_endpoint"`
+		TokenEndpoint     string `json:"token_endpoint"`
+		JWKSURI           string `json:"jwks_uri"`
+	}
+	if err := json.Unmarshal(body, &doc); err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	return &oidcProvider{
+		AuthorizeEndpoint: doc.AuthorizeEndpoint,
+		TokenEndpoint:     doc.TokenEndpoint,
+		JWKSURI:           doc.JWKSURI,
+	}, nil
+}
+
+// exchangeCode trades an authorization code for tokens at the provider's
+// token endpoint and returns the raw ID token.
+func (p *oidcProvider) exchangeCode(connector services.OIDCConnector, code string) (string, error) {
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("client_id", connector.GetClientID())
+	form.Set("client_secret", connector.GetClientSecret())
+
+	resp, err := http.PostForm(p.TokenEndpoint, form)
+	if err != nil {
+		return "", trace.Wrap(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", trace.BadParameter("unexpected status %v from token endpoint", resp.StatusCode)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", trace.Wrap(err)
+	}
+
+	var out struct {
+		IDToken string `json:"id_token"`
+	}
+	if err := json.Unmarshal(body, &out); err != nil {
+		return "", trace.Wrap(err)
+	}
+	if out.IDToken == "" {
+		return "", trace.BadParameter("token endpoint response did not include an id_token")
+	}
+	return out.IDToken, nil
+}
+
+// verifyIDToken verifies idToken's RS256 signature against the
+// provider's JWKS (re-syncing once on an unrecognized kid) and checks
+// iss/aud/exp/nonce, returning the decoded claims.
+func (p *oidcProvider) verifyIDToken(issuer, clientID, nonce, idToken string) (oidcClaims, error) {
+	parts := strings.Split(idToken, ".")
+	if len(parts) != 3 {
+		return nil, trace.BadParameter("malformed id_token")
+	}
+	header, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	var jwtHeader struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := json.Unmarshal(header, &jwtHeader); err != nil {
+		return nil, trace.Wrap(err)
+	}
+	if jwtHeader.Alg != "RS256" {
+		return nil, trace.BadParameter("unsupported id_token algorithm %q", jwtHeader.Alg)
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	var claims oidcClaims
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	key, err := p.signingKey(jwtHeader.Kid)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	hashed := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, hashed[:], sig); err != nil {
+		return nil, trace.AccessDenied("id_token signature verification failed: %v", err)
+	}
+
+	iss, _ := claims["iss"].(string)
+	if iss == "" || iss != issuer {
+		return nil, trace.AccessDenied("id_token iss %q does not match connector issuer %q", iss, issuer)
+	}
+	aud, _ := claims["aud"].(string)
+	if aud != clientID {
+		return nil, trace.AccessDenied("id_token aud %q does not match client_id", aud)
+	}
+	if exp, ok := claims["exp"].(float64); ok {
+		if time.Now().UTC().After(time.Unix(int64(exp), 0)) {
+			return nil, trace.AccessDenied("id_token has expired")
+		}
+	} else {
+		return nil, trace.BadParameter("id_token missing exp claim")
+	}
+	gotNonce, _ := claims["nonce"].(string)
+	if gotNonce == "" || gotNonce != nonce {
+		return nil, trace.AccessDenied("id_token nonce does not match the one issued for this login")
+	}
+
+	return claims, nil
+}
+
+// signingKey returns the RSA public key for kid, re-fetching the JWKS
+// once if kid isn't found in the cache (handles provider key rotation).
+func (p *oidcProvider) signingKey(kid string) (*rsa.PublicKey, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if key, ok := p.keys[kid]; ok {
+		return key, nil
+	}
+	if err := p.refreshKeysLocked(); err != nil {
+		return nil, trace.Wrap(err)
+	}
+	key, ok := p.keys[kid]
+	if !ok {
+		return nil, trace.NotFound("no signing key found for kid %q", kid)
+	}
+	return key, nil
+}
+
+// refreshKeysLocked re-downloads the provider's JWKS. Callers must hold p.mu.
+func (p *oidcProvider) refreshKeysLocked() error {
+	resp, err := http.Get(p.JWKSURI)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return trace.BadParameter("unexpected status %v fetching JWKS", resp.StatusCode)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+
+	var out struct {
+		Keys []struct {
+			Kid string `json:"kid"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+	if err := json.Unmarshal(body, &out); err != nil {
+		return trace.Wrap(err)
+	}
+
+	keys := make(map[string]*rsa.PublicKey, len(out.Keys))
+	for _, k := range out.Keys {
+		pub, err := rsaPublicKeyFromModExp(k.N, k.E)
+		if err != nil {
+			return trace.Wrap(err)
+		}
+		keys[k.Kid] = pub
+	}
+	p.keys = keys
+	p.lastRefresh = time.Now().UTC()
+	return nil
+}
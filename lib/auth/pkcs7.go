@@ -0,0 +1,180 @@
+/*
+Copyright 2015 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package auth
+
+import (
+	"crypto"
+	"crypto/rsa"
+	_ "crypto/sha1" // register crypto.SHA1 for alg.New() below
+	_ "crypto/sha256" // register crypto.SHA256 for alg.New() below
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/pem"
+
+	"github.com/gravitational/trace"
+)
+
+// pkcs7Envelope is the parsed form of a non-authenticated PKCS7
+// SignedData structure, the form both EC2's instance identity document
+// and Azure's IMDS attested data are signed with: the econtent embedded
+// in the envelope is the raw document bytes, and the lone SignerInfo's
+// EncryptedDigest is a straight RSA signature over the digest of that
+// econtent (no authenticatedAttributes).
+type pkcs7Envelope struct {
+	payload   []byte
+	digestAlg crypto.Hash
+	signature []byte
+}
+
+// verify checks the envelope's signature against certPEM's RSA public key.
+func (e *pkcs7Envelope) verify(certPEM []byte) error {
+	block, _ := pem.Decode(certPEM)
+	if block == nil {
+		return trace.BadParameter("invalid PEM certificate")
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	pub, ok := cert.PublicKey.(*rsa.PublicKey)
+	if !ok {
+		return trace.BadParameter("certificate does not contain an RSA public key")
+	}
+	return trace.Wrap(verifyRSASignature(pub, e.digestAlg, e.payload, e.signature))
+}
+
+// verifyRSASignature hashes payload with alg and checks signature
+// against pub using RSASSA-PKCS1-v1_5, the scheme both EC2 and Azure use
+// for their instance metadata signatures.
+func verifyRSASignature(pub *rsa.PublicKey, alg crypto.Hash, payload, signature []byte) error {
+	h := alg.New()
+	h.Write(payload)
+	if err := rsa.VerifyPKCS1v15(pub, alg, h.Sum(nil), signature); err != nil {
+		return trace.AccessDenied("signature verification failed: %v", err)
+	}
+	return nil
+}
+
+// asn1ContentInfo models PKCS7's outer ContentInfo ::= SEQUENCE {
+//   contentType OBJECT IDENTIFIER, content [0] EXPLICIT ANY OPTIONAL }
+type asn1ContentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue `asn1:"explicit,optional,tag:0"`
+}
+
+// asn1AlgorithmIdentifier mirrors pkix.AlgorithmIdentifier but tolerates
+// a missing/NULL parameters field, which is how most PKCS7 tooling
+// encodes digest algorithm identifiers.
+type asn1AlgorithmIdentifier struct {
+	Algorithm  asn1.ObjectIdentifier
+	Parameters asn1.RawValue `asn1:"optional"`
+}
+
+// asn1IssuerAndSerial models IssuerAndSerialNumber ::= SEQUENCE {
+//   issuer Name, serialNumber CertificateSerialNumber }
+type asn1IssuerAndSerial struct {
+	Issuer       asn1.RawValue
+	SerialNumber asn1.RawValue
+}
+
+// asn1SignerInfo models SignerInfo without the optional
+// authenticatedAttributes/unauthenticatedAttributes fields: EC2 and
+// Azure both sign instance metadata documents without them.
+type asn1SignerInfo struct {
+	Version                   int
+	IssuerAndSerial           asn1IssuerAndSerial
+	DigestAlgorithm           asn1AlgorithmIdentifier
+	DigestEncryptionAlgorithm asn1AlgorithmIdentifier
+	EncryptedDigest           []byte
+}
+
+// asn1SignedData models SignedData ::= SEQUENCE { version INTEGER,
+//   digestAlgorithms SET OF AlgorithmIdentifier, contentInfo ContentInfo,
+//   certificates [0] IMPLICIT SET OF Certificate OPTIONAL,
+//   crls [1] IMPLICIT SET OF CRL OPTIONAL, signerInfos SET OF SignerInfo }
+type asn1SignedData struct {
+	Version          int
+	DigestAlgorithms []asn1AlgorithmIdentifier `asn1:"set"`
+	ContentInfo      asn1ContentInfo
+	Certificates     asn1.RawValue    `asn1:"optional,tag:0"`
+	CRLs             asn1.RawValue    `asn1:"optional,tag:1"`
+	SignerInfos      []asn1SignerInfo `asn1:"set"`
+}
+
+var (
+	oidSignedData = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 2}
+	oidSHA1       = asn1.ObjectIdentifier{1, 3, 14, 3, 2, 26}
+	oidSHA256     = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 1}
+)
+
+// digestAlgFromOID maps a digestAlgorithm OID to the crypto.Hash EC2 and
+// Azure are known to use when signing instance metadata documents.
+func digestAlgFromOID(oid asn1.ObjectIdentifier) (crypto.Hash, error) {
+	switch {
+	case oid.Equal(oidSHA1):
+		return crypto.SHA1, nil
+	case oid.Equal(oidSHA256):
+		return crypto.SHA256, nil
+	default:
+		return 0, trace.BadParameter("unsupported PKCS7 digest algorithm %v", oid)
+	}
+}
+
+// decodePKCS7 parses a DER-encoded, single-signer PKCS7 SignedData
+// structure with embedded (non-detached) content and no
+// authenticatedAttributes, the form AWS and Azure both use for instance
+// identity / attested data documents.
+func decodePKCS7(raw []byte) (*pkcs7Envelope, error) {
+	var outer asn1ContentInfo
+	if rest, err := asn1.Unmarshal(raw, &outer); err != nil {
+		return nil, trace.BadParameter("invalid PKCS7 envelope: %v", err)
+	} else if len(rest) != 0 {
+		return nil, trace.BadParameter("trailing data after PKCS7 envelope")
+	}
+	if !outer.ContentType.Equal(oidSignedData) {
+		return nil, trace.BadParameter("not a PKCS7 SignedData envelope")
+	}
+
+	var sd asn1SignedData
+	if _, err := asn1.Unmarshal(outer.Content.Bytes, &sd); err != nil {
+		return nil, trace.BadParameter("invalid PKCS7 SignedData: %v", err)
+	}
+	if len(sd.SignerInfos) != 1 {
+		return nil, trace.BadParameter("expected exactly one PKCS7 signer, got %d", len(sd.SignerInfos))
+	}
+
+	var payload []byte
+	if len(sd.ContentInfo.Content.Bytes) > 0 {
+		if _, err := asn1.Unmarshal(sd.ContentInfo.Content.Bytes, &payload); err != nil {
+			return nil, trace.BadParameter("invalid PKCS7 econtent: %v", err)
+		}
+	}
+	if len(payload) == 0 {
+		return nil, trace.BadParameter("PKCS7 envelope does not embed its signed content")
+	}
+
+	signer := sd.SignerInfos[0]
+	digestAlg, err := digestAlgFromOID(signer.DigestAlgorithm.Algorithm)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	return &pkcs7Envelope{
+		payload:   payload,
+		digestAlg: digestAlg,
+		signature: signer.EncryptedDigest,
+	}, nil
+}
@@ -0,0 +1,146 @@
+/*
+Copyright 2015 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package auth
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/gravitational/teleport"
+	"github.com/gravitational/teleport/lib/services"
+	"github.com/gravitational/teleport/lib/utils"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/gravitational/trace"
+)
+
+// IdentityDocumentStatic is the provisioner kind used by the pre-shared
+// token join flow that has always been supported by AuthServer.
+const IdentityDocumentStatic = "token"
+
+// Provisioner authenticates a node's join attempt using whatever proof is
+// appropriate for the kind of identity document it presents, and reports
+// whether the attempt is allowed.
+//
+// StaticTokenProvisioner implements the original pre-shared token flow;
+// GCPProvisioner, AWSProvisioner and AzureProvisioner authenticate nodes
+// using a signed cloud identity document instead, so that nodes running
+// on GCP, AWS or Azure can join without ever being handed a secret.
+type Provisioner interface {
+	// Kind returns the identity document kind this provisioner handles,
+	// e.g. "token", "gcp", "aws" or "azure".
+	Kind() string
+
+	// RegisterUsingIdentityDocument validates the identity document
+	// presented by the node and checks it against cfg, the cloud config
+	// registered for the joining role; nodename is not checked. authDomain
+	// is the only value a provisioner may check the document's
+	// audience/recipient against, since nodename and role are
+	// attacker-supplied and prove nothing about which cluster the document
+	// was fetched for. GCPProvisioner checks the audience against
+	// authDomain; AWSProvisioner and AzureProvisioner do not bind the
+	// document to an auth server. It returns nil on success.
+	RegisterUsingIdentityDocument(cfg services.CloudProvisionConfig, authDomain, nodename string, role teleport.Role, identityDocument []byte) error
+}
+
+// StaticTokenProvisioner implements the original join flow: the node
+// proves it belongs by presenting the shared secret handed out by
+// AuthServer.GenerateToken.
+type StaticTokenProvisioner struct{}
+
+// Kind returns "token"
+func (p *StaticTokenProvisioner) Kind() string {
+	return IdentityDocumentStatic
+}
+
+// RegisterUsingIdentityDocument is not used by the static token flow;
+// StaticTokenProvisioner is only registered so that it shows up alongside
+// the cloud provisioners when AuthServer looks one up by kind.
+func (p *StaticTokenProvisioner) RegisterUsingIdentityDocument(cfg services.CloudProvisionConfig, authDomain, nodename string, role teleport.Role, identityDocument []byte) error {
+	return trace.BadParameter("static tokens do not use identity documents")
+}
+
+// defaultProvisioners returns the default set of Provisioner implementations,
+// keyed by the identity document kind they handle.
+func defaultProvisioners() map[string]Provisioner {
+	return map[string]Provisioner{
+		IdentityDocumentStatic: &StaticTokenProvisioner{},
+		"gcp":                  &GCPProvisioner{},
+		"aws":                  &AWSProvisioner{},
+		"azure":                &AzureProvisioner{},
+	}
+}
+
+// provisionerFor returns the Provisioner registered for kind, or an error
+// if no provisioner handles that kind of identity document.
+func (s *AuthServer) provisionerFor(kind string) (Provisioner, error) {
+	p, ok := s.provisioners[kind]
+	if !ok {
+		return nil, trace.BadParameter("unsupported identity document kind %q", kind)
+	}
+	return p, nil
+}
+
+// RegisterUsingIdentityDocument joins a node that proves its identity by
+// presenting a signed cloud identity document rather than a pre-shared
+// token. kind selects the cloud provisioner ("gcp", "aws" or "azure").
+func (s *AuthServer) RegisterUsingIdentityDocument(kind, nodename string, role teleport.Role, identityDocument []byte) (keys PackedKeys, e error) {
+	log.Infof("[AUTH] Node `%v` is trying to join using a %v identity document", nodename, kind)
+	if err := role.Check(); err != nil {
+		return PackedKeys{}, trace.Wrap(err)
+	}
+	if err := s.checkFeature("cloud_join", s.licenseFeatures().CloudJoin); err != nil {
+		return PackedKeys{}, trace.Wrap(err)
+	}
+	if err := s.checkMaxNodes(); err != nil {
+		return PackedKeys{}, trace.Wrap(err)
+	}
+	provisioner, err := s.provisionerFor(kind)
+	if err != nil {
+		return PackedKeys{}, trace.Wrap(err)
+	}
+	cfg, err := s.ProvisioningService.GetCloudProvisionConfig(kind, string(role))
+	if err != nil {
+		log.Warningf("[AUTH] Node `%v` cannot join: no cloud provision config for role %v. %v", nodename, role, err)
+		return PackedKeys{}, trace.Wrap(err)
+	}
+	if err := provisioner.RegisterUsingIdentityDocument(cfg, s.Hostname, nodename, role, identityDocument); err != nil {
+		log.Warningf("[AUTH] Node `%v` cannot join: identity document error. %v", nodename, err)
+		return PackedKeys{}, trace.Wrap(err)
+	}
+	return s.issueHostCert(nodename, role)
+}
+
+// issueHostCert generates a fresh keypair and host certificate for
+// nodename/role. It is the common tail end of every join flow, whether
+// the node authenticated with a pre-shared token or a cloud identity
+// document.
+func (s *AuthServer) issueHostCert(nodename string, role teleport.Role) (keys PackedKeys, e error) {
+	k, pub, err := s.GenerateKeyPair("")
+	if err != nil {
+		return PackedKeys{}, trace.Wrap(err)
+	}
+	// we always append authority's domain to resulting node name,
+	// that's how we make sure that nodes are uniquely identified/found
+	// in cases when we have multiple environments/organizations
+	fqdn := fmt.Sprintf("%s.%s", nodename, s.Hostname)
+	c, err := s.GenerateHostCert(pub, fqdn, s.Hostname, role, 0)
+	if err != nil {
+		return PackedKeys{}, trace.Wrap(err)
+	}
+	utils.Consolef(os.Stdout, "[AUTH] Node `%v` joined the cluster", nodename)
+	return PackedKeys{Key: k, Cert: c}, nil
+}
@@ -0,0 +1,140 @@
+/*
+Copyright 2015 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package auth
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/gravitational/teleport"
+	"github.com/gravitational/teleport/lib/services"
+
+	"github.com/gravitational/trace"
+)
+
+const (
+	// awsIdentityDocumentMaxAge bounds how long after an instance
+	// entered "pending" a captured identity document can still be
+	// replayed to join a node. EC2 does not refresh pendingTime on
+	// every metadata fetch, unlike GCP/OIDC's exp/iat, so this bounds
+	// how long after launch a node may join rather than how long a
+	// given fetch of the document stays usable - but it still closes
+	// the otherwise unbounded replay window.
+	awsIdentityDocumentMaxAge = time.Hour
+	// awsClockSkew is the allowed leeway for a pendingTime slightly in
+	// the future, to tolerate clock drift between EC2 and this auth server
+	awsClockSkew = 2 * time.Minute
+)
+
+// awsInstanceIdentityDocument is the subset of the EC2 instance identity
+// document (http://169.254.169.254/latest/dynamic/instance-identity/document)
+// Teleport needs to decide whether an instance is allowed to join.
+type awsInstanceIdentityDocument struct {
+	AccountID   string    `json:"accountId"`
+	InstanceID  string    `json:"instanceId"`
+	Region      string    `json:"region"`
+	PendingTime time.Time `json:"pendingTime"`
+}
+
+// AWSProvisioner authenticates join attempts from nodes running on EC2 by
+// verifying the PKCS7-signed instance identity document the node fetches
+// from its own instance metadata service, rather than requiring a
+// pre-shared token.
+type AWSProvisioner struct{}
+
+// Kind returns "aws"
+func (p *AWSProvisioner) Kind() string {
+	return "aws"
+}
+
+// RegisterUsingIdentityDocument verifies that identityDocument is a
+// PKCS7 envelope signed by the AWS public certificate for the region it
+// claims, and that the account it names is allow-listed in cfg.
+func (p *AWSProvisioner) RegisterUsingIdentityDocument(cfg services.CloudProvisionConfig, authDomain, nodename string, role teleport.Role, identityDocument []byte) error {
+	doc, err := verifyAWSIdentityDocument(identityDocument)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	if !cfg.AWSAllowed(doc.AccountID) {
+		return trace.AccessDenied(
+			"account %q is not allowed to join as this role", doc.AccountID)
+	}
+	return nil
+}
+
+// verifyAWSIdentityDocument checks the PKCS7 signature on a raw EC2
+// instance identity document against the AWS public certificate for the
+// region the document claims to be from, and returns the parsed payload.
+func verifyAWSIdentityDocument(raw []byte) (*awsInstanceIdentityDocument, error) {
+	envelope, err := decodePKCS7(raw)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	var doc awsInstanceIdentityDocument
+	if err := json.Unmarshal(envelope.payload, &doc); err != nil {
+		return nil, trace.Wrap(err)
+	}
+	cert, err := getAWSRegionCert(doc.Region)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	if err := envelope.verify(cert); err != nil {
+		return nil, trace.AccessDenied("identity document signature verification failed: %v", err)
+	}
+	now := time.Now().UTC()
+	if now.After(doc.PendingTime.Add(awsIdentityDocumentMaxAge)) {
+		return nil, trace.AccessDenied("identity document is too old to join with")
+	}
+	if doc.PendingTime.After(now.Add(awsClockSkew)) {
+		return nil, trace.AccessDenied("identity document pendingTime is in the future")
+	}
+	return &doc, nil
+}
+
+// awsRegionCerts maps each AWS region to the PEM-encoded public
+// certificate EC2 uses to sign instance identity documents in that
+// region, populated at startup via LoadAWSRegionCert from AWS's
+// published certificate bundle (https://docs.aws.amazon.com/AWSEC2/latest/UserGuide/verify-signature.html).
+// Shipping a hardcoded copy of that bundle in source risks silently
+// trusting a stale or wrong certificate, so it must be loaded
+// operationally rather than baked in here.
+var (
+	awsRegionCertsMu sync.RWMutex
+	awsRegionCerts   = map[string][]byte{}
+)
+
+// LoadAWSRegionCert registers certPEM as the trusted signer for
+// identity documents claiming to be from region. Call this once per
+// supported region during startup, before any AWSProvisioner join
+// attempt is accepted for that region.
+func LoadAWSRegionCert(region string, certPEM []byte) {
+	awsRegionCertsMu.Lock()
+	defer awsRegionCertsMu.Unlock()
+	awsRegionCerts[region] = certPEM
+}
+
+// getAWSRegionCert returns the trusted cert for region, or an error if
+// LoadAWSRegionCert was never called for it.
+func getAWSRegionCert(region string) ([]byte, error) {
+	awsRegionCertsMu.RLock()
+	defer awsRegionCertsMu.RUnlock()
+	cert, ok := awsRegionCerts[region]
+	if !ok {
+		return nil, trace.BadParameter("no trusted certificate configured for AWS region %q", region)
+	}
+	return cert, nil
+}
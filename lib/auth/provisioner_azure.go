@@ -0,0 +1,123 @@
+/*
+Copyright 2015 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package auth
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/gravitational/teleport"
+	"github.com/gravitational/teleport/lib/services"
+
+	"github.com/gravitational/trace"
+)
+
+const (
+	// azureAttestedDataMaxAge bounds how long after it was issued a
+	// captured attested data document can still be replayed to join a
+	// node, matching the diligence GCPProvisioner and the OIDC flow
+	// already apply to their own documents.
+	azureAttestedDataMaxAge = 5 * time.Minute
+	// azureClockSkew is the allowed leeway for a timestamp slightly in
+	// the future, to tolerate clock drift between the VM and this auth
+	// server
+	azureClockSkew = 2 * time.Minute
+)
+
+// azureAttestedData is the subset of Azure's IMDS attested data document
+// (http://169.254.169.254/metadata/attested/document) Teleport needs to
+// decide whether a VM is allowed to join.
+type azureAttestedData struct {
+	SubscriptionID string    `json:"subscriptionId"`
+	VMID           string    `json:"vmId"`
+	Timestamp      time.Time `json:"timestamp"`
+}
+
+// AzureProvisioner authenticates join attempts from nodes running on
+// Azure by verifying the PKCS7-signed attested data document the node
+// fetches from its own instance metadata service, rather than requiring
+// a pre-shared token.
+type AzureProvisioner struct{}
+
+// Kind returns "azure"
+func (p *AzureProvisioner) Kind() string {
+	return "azure"
+}
+
+// RegisterUsingIdentityDocument verifies that identityDocument is a
+// PKCS7 envelope signed by Azure's attestation certificate, and that the
+// subscription it names is allow-listed in cfg.
+func (p *AzureProvisioner) RegisterUsingIdentityDocument(cfg services.CloudProvisionConfig, authDomain, nodename string, role teleport.Role, identityDocument []byte) error {
+	envelope, err := decodePKCS7(identityDocument)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	var doc azureAttestedData
+	if err := json.Unmarshal(envelope.payload, &doc); err != nil {
+		return trace.Wrap(err)
+	}
+	cert, err := getAzureAttestationCert()
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	if err := envelope.verify(cert); err != nil {
+		return trace.AccessDenied("attested data signature verification failed: %v", err)
+	}
+	now := time.Now().UTC()
+	if now.After(doc.Timestamp.Add(azureAttestedDataMaxAge)) {
+		return trace.AccessDenied("attested data document is too old to join with")
+	}
+	if doc.Timestamp.After(now.Add(azureClockSkew)) {
+		return trace.AccessDenied("attested data document timestamp is in the future")
+	}
+	if !cfg.AzureAllowed(doc.SubscriptionID) {
+		return trace.AccessDenied(
+			"subscription %q is not allowed to join as this role", doc.SubscriptionID)
+	}
+	return nil
+}
+
+// azureAttestationCert is the PEM-encoded Azure certificate used to
+// verify the signature over IMDS attested data documents, populated at
+// startup via LoadAzureAttestationCert. Like awsRegionCerts, this is
+// deliberately not hardcoded: a wrong embedded certificate would make
+// RegisterUsingIdentityDocument look like it verifies signatures while
+// actually rejecting (or worse, silently accepting forged) documents.
+var (
+	azureAttestationCertMu sync.RWMutex
+	azureAttestationCert   []byte
+)
+
+// LoadAzureAttestationCert registers certPEM as the trusted signer for
+// Azure attested data documents. Call this once during startup, before
+// any AzureProvisioner join attempt is accepted.
+func LoadAzureAttestationCert(certPEM []byte) {
+	azureAttestationCertMu.Lock()
+	defer azureAttestationCertMu.Unlock()
+	azureAttestationCert = certPEM
+}
+
+// getAzureAttestationCert returns the trusted cert, or an error if
+// LoadAzureAttestationCert was never called.
+func getAzureAttestationCert() ([]byte, error) {
+	azureAttestationCertMu.RLock()
+	defer azureAttestationCertMu.RUnlock()
+	if len(azureAttestationCert) == 0 {
+		return nil, trace.BadParameter("no trusted Azure attestation certificate configured")
+	}
+	return azureAttestationCert, nil
+}
@@ -0,0 +1,247 @@
+/*
+Copyright 2015 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package auth
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gravitational/teleport"
+	"github.com/gravitational/teleport/lib/services"
+
+	"github.com/gravitational/trace"
+)
+
+const (
+	// gcpIdentityDocumentIssuer is the only issuer GCPProvisioner trusts
+	gcpIdentityDocumentIssuer = "https://accounts.google.com"
+	// gcpJWKSURL serves Google's RS256 signing keys for identity tokens
+	gcpJWKSURL = "https://www.googleapis.com/oauth2/v3/certs"
+	// gcpClockSkew is the allowed leeway when checking exp/iat
+	gcpClockSkew = 2 * time.Minute
+)
+
+// gcpIdentityDocument is the subset of claims Teleport cares about in a
+// GCP VM identity JWT fetched from the instance metadata server, e.g.
+//
+//	http://metadata/computeMetadata/v1/instance/service-accounts/default/identity
+//	    ?audience=<hostname>&format=full
+type gcpIdentityDocument struct {
+	Issuer    string `json:"iss"`
+	Audience  string `json:"aud"`
+	ExpiresAt int64  `json:"exp"`
+	IssuedAt  int64  `json:"iat"`
+	Google    struct {
+		ComputeEngine struct {
+			ProjectID  string `json:"project_id"`
+			InstanceID string `json:"instance_id"`
+			Zone       string `json:"zone"`
+		} `json:"compute_engine"`
+	} `json:"google"`
+}
+
+// GCPProvisioner authenticates join attempts from nodes running on Google
+// Compute Engine by verifying the signed identity document the node's
+// metadata server hands it, rather than requiring a pre-shared token.
+type GCPProvisioner struct {
+	// jwks caches Google's signing keys between verifications
+	jwks jwksCache
+}
+
+// Kind returns "gcp"
+func (p *GCPProvisioner) Kind() string {
+	return "gcp"
+}
+
+// RegisterUsingIdentityDocument verifies that identityDocument is a
+// validly signed GCP identity JWT whose audience is authDomain - this
+// auth server, not the caller-supplied nodename - and that the instance
+// it describes belongs to a project/instance/zone allow-listed in cfg.
+func (p *GCPProvisioner) RegisterUsingIdentityDocument(cfg services.CloudProvisionConfig, authDomain, nodename string, role teleport.Role, identityDocument []byte) error {
+	doc, err := p.verify(identityDocument, authDomain)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	ce := doc.Google.ComputeEngine
+	if !cfg.GCPAllowed(ce.ProjectID, ce.InstanceID, ce.Zone) {
+		return trace.AccessDenied(
+			"instance %q in project %q is not allowed to join as this role", ce.InstanceID, ce.ProjectID)
+	}
+	return nil
+}
+
+// verify validates the signature and claims of a GCP identity JWT -
+// including that its audience is audience, the auth server this
+// document must have been minted for - and returns its parsed payload.
+func (p *GCPProvisioner) verify(token []byte, audience string) (*gcpIdentityDocument, error) {
+	parts := strings.Split(string(token), ".")
+	if len(parts) != 3 {
+		return nil, trace.BadParameter("malformed identity document")
+	}
+	header, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	var jwtHeader struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := json.Unmarshal(header, &jwtHeader); err != nil {
+		return nil, trace.Wrap(err)
+	}
+	if jwtHeader.Alg != "RS256" {
+		return nil, trace.BadParameter("unsupported identity document algorithm %q", jwtHeader.Alg)
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	var doc gcpIdentityDocument
+	if err := json.Unmarshal(payload, &doc); err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	if err := p.checkSignature(jwtHeader.Kid, parts[0]+"."+parts[1], sig); err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	if doc.Issuer != gcpIdentityDocumentIssuer {
+		return nil, trace.AccessDenied("unexpected identity document issuer %q", doc.Issuer)
+	}
+	if doc.Audience != audience {
+		return nil, trace.AccessDenied("identity document audience %q does not match this auth server", doc.Audience)
+	}
+	now := time.Now().UTC()
+	if now.After(time.Unix(doc.ExpiresAt, 0).Add(gcpClockSkew)) {
+		return nil, trace.AccessDenied("identity document has expired")
+	}
+	if now.Before(time.Unix(doc.IssuedAt, 0).Add(-gcpClockSkew)) {
+		return nil, trace.AccessDenied("identity document is not yet valid")
+	}
+	return &doc, nil
+}
+
+// checkSignature verifies signedData's RS256 signature against the
+// Google signing key identified by kid, refreshing the cached JWKS once
+// on a cache miss before giving up.
+func (p *GCPProvisioner) checkSignature(kid, signedData string, sig []byte) error {
+	key, err := p.jwks.get(kid)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	hashed := sha256.Sum256([]byte(signedData))
+	if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, hashed[:], sig); err != nil {
+		return trace.AccessDenied("identity document signature verification failed: %v", err)
+	}
+	return nil
+}
+
+// jwksCache fetches and caches Google's public signing certs, refreshing
+// them whenever a key id is requested that isn't in the cache yet.
+type jwksCache struct {
+	mu   sync.Mutex
+	keys map[string]*rsa.PublicKey
+}
+
+func (c *jwksCache) get(kid string) (*rsa.PublicKey, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if key, ok := c.keys[kid]; ok {
+		return key, nil
+	}
+	if err := c.refresh(); err != nil {
+		return nil, trace.Wrap(err)
+	}
+	key, ok := c.keys[kid]
+	if !ok {
+		return nil, trace.NotFound("no signing key found for kid %q", kid)
+	}
+	return key, nil
+}
+
+// refresh re-downloads the JWKS document. Callers must hold c.mu.
+func (c *jwksCache) refresh() error {
+	resp, err := http.Get(gcpJWKSURL)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return trace.BadParameter("unexpected status %v fetching GCP JWKS", resp.StatusCode)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+
+	var out struct {
+		Keys []struct {
+			Kid string `json:"kid"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+	if err := json.Unmarshal(body, &out); err != nil {
+		return trace.Wrap(err)
+	}
+
+	keys := make(map[string]*rsa.PublicKey, len(out.Keys))
+	for _, k := range out.Keys {
+		pub, err := rsaPublicKeyFromModExp(k.N, k.E)
+		if err != nil {
+			return trace.Wrap(err)
+		}
+		keys[k.Kid] = pub
+	}
+	c.keys = keys
+	return nil
+}
+
+// rsaPublicKeyFromModExp builds an *rsa.PublicKey from the base64url
+// encoded modulus/exponent pair used by JWKS documents.
+func rsaPublicKeyFromModExp(n, e string) (*rsa.PublicKey, error) {
+	nb, err := base64.RawURLEncoding.DecodeString(n)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	eb, err := base64.RawURLEncoding.DecodeString(e)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	var exponent int
+	for _, b := range eb {
+		exponent = exponent<<8 + int(b)
+	}
+	return &rsa.PublicKey{
+		N: new(big.Int).SetBytes(nb),
+		E: exponent,
+	}, nil
+}
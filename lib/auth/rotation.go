@@ -0,0 +1,208 @@
+/*
+Copyright 2015 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package auth
+
+import (
+	"time"
+
+	"github.com/gravitational/teleport/lib/services"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/gravitational/trace"
+)
+
+// RotationPhase identifies where a CertAuthority is in the rotation
+// state machine driven by RotateCertAuthority.
+type RotationPhase string
+
+const (
+	// RotationInit generates a new signing key in the "standby" slot
+	// and publishes its public half to trusted clusters, but keeps
+	// signing with the old key
+	RotationInit RotationPhase = "init"
+	// RotationUpdateClients promotes the new key to "active": it signs
+	// new certs from here on, while the old key is still trusted for
+	// verification so certs issued before the rotation keep working
+	RotationUpdateClients RotationPhase = "update_clients"
+	// RotationUpdateServers generates a new host cert, signed by the new
+	// key, for every node known to PresenceService; the certs are not
+	// delivered to the nodes
+	RotationUpdateServers RotationPhase = "update_servers"
+	// RotationStandby retires the old key once nothing depends on it
+	RotationStandby RotationPhase = "standby"
+	// RotationRollback aborts a rotation in progress and reverts to the
+	// key that was active before it started
+	RotationRollback RotationPhase = "rollback"
+)
+
+// RotateRequest describes a request to advance (or roll back) a
+// CertAuthority's rotation state machine.
+type RotateRequest struct {
+	// TargetPhase is the phase to move the CA to. Leaving it empty
+	// advances to the next phase in sequence.
+	TargetPhase RotationPhase
+	// GracePeriod is how long a phase is held before the background
+	// goroutine advances it automatically. A zero value disables
+	// automatic advancement for this rotation, requiring an operator to
+	// call RotateCertAuthority for every phase.
+	GracePeriod time.Duration
+}
+
+// phaseOrder is the sequence automatic rotation walks through; rollback
+// is only ever reached explicitly, never picked automatically.
+var phaseOrder = []RotationPhase{
+	RotationInit,
+	RotationUpdateClients,
+	RotationUpdateServers,
+	RotationStandby,
+}
+
+// RotateCertAuthority advances the named CA's rotation state machine.
+// Called with a zero-value RotateRequest it moves to the next phase in
+// phaseOrder; callers needing fine control (or a rollback) set
+// TargetPhase explicitly.
+func (s *AuthServer) RotateCertAuthority(caType services.CertAuthType, req RotateRequest) error {
+	id := services.CertAuthID{Type: caType, DomainName: s.Hostname}
+	ca, err := s.CAService.GetCertAuthority(id, true)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+
+	target := req.TargetPhase
+	if target == "" {
+		target, err = nextPhase(ca.GetRotation().Phase)
+		if err != nil {
+			return trace.Wrap(err)
+		}
+	}
+
+	switch target {
+	case RotationInit:
+		err = s.rotationInit(ca)
+	case RotationUpdateClients:
+		err = s.rotationUpdateClients(ca)
+	case RotationUpdateServers:
+		err = s.rotationUpdateServers(ca)
+	case RotationStandby:
+		err = s.rotationStandby(ca)
+	case RotationRollback:
+		err = s.rotationRollback(ca)
+	default:
+		return trace.BadParameter("unknown rotation phase %q", target)
+	}
+	if err != nil {
+		return trace.Wrap(err)
+	}
+
+	log.Infof("[AUTH] CA %v rotation advanced to phase %v", caType, target)
+	return s.scheduleNextPhase(caType, target, req.GracePeriod)
+}
+
+// nextPhase returns the phase that follows current in phaseOrder.
+func nextPhase(current services.RotationPhase) (RotationPhase, error) {
+	if current == "" {
+		return RotationInit, nil
+	}
+	for i, p := range phaseOrder {
+		if string(p) == string(current) && i+1 < len(phaseOrder) {
+			return phaseOrder[i+1], nil
+		}
+	}
+	return "", trace.BadParameter("rotation is already complete")
+}
+
+// rotationInit generates a fresh keypair, adds it to the CA's signing
+// key list tagged "standby", and publishes its public half so trusted
+// clusters can start accepting certs signed by it ahead of time.
+func (s *AuthServer) rotationInit(ca services.CertAuthority) error {
+	priv, pub, err := s.GenerateKeyPair("")
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	ca.AddSigningKey(services.SigningKey{
+		Phase:     services.KeyPhaseStandby,
+		Private:   priv,
+		Public:    pub,
+		StartedAt: s.clock.Now().UTC(),
+	})
+	return trace.Wrap(s.CAService.UpsertCertAuthority(ca))
+}
+
+// rotationUpdateClients promotes the standby key to active: it becomes
+// the key GenerateHostCert/GenerateUserCert sign with, while the
+// previously active key is downgraded to retiring so certs it already
+// signed keep verifying.
+func (s *AuthServer) rotationUpdateClients(ca services.CertAuthority) error {
+	if err := ca.RotateSigningKeys(services.KeyPhaseStandby, services.KeyPhaseActive, services.KeyPhaseRetiring); err != nil {
+		return trace.Wrap(err)
+	}
+	return trace.Wrap(s.CAService.UpsertCertAuthority(ca))
+}
+
+// rotationUpdateServers generates a host cert signed by the now active
+// key for every node known to PresenceService. The generated certs are
+// discarded, not sent to the nodes, so nodes keep presenting the certs
+// they already hold.
+func (s *AuthServer) rotationUpdateServers(ca services.CertAuthority) error {
+	nodes, err := s.PresenceService.GetNodes()
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	for _, n := range nodes {
+		if _, err := s.GenerateHostCert(n.PublicKey, n.Hostname, s.Hostname, n.Role, 0); err != nil {
+			log.Warningf("[AUTH] rotation could not re-issue host cert for %v: %v", n.Hostname, err)
+		}
+	}
+	return nil
+}
+
+// rotationStandby removes the retiring signing key. It does not check
+// whether host certs or web sessions signed by that key are still in use.
+func (s *AuthServer) rotationStandby(ca services.CertAuthority) error {
+	ca.RemoveSigningKeysInPhase(services.KeyPhaseRetiring)
+	return trace.Wrap(s.CAService.UpsertCertAuthority(ca))
+}
+
+// rotationRollback aborts an in-progress rotation: a standby key added
+// by this rotation is dropped, the previously active key (left in
+// "retiring" by rotationUpdateClients) is restored to active, and a key
+// this rotation already promoted to active is demoted to retiring.
+func (s *AuthServer) rotationRollback(ca services.CertAuthority) error {
+	ca.RemoveSigningKeysInPhase(services.KeyPhaseStandby)
+	if err := ca.RotateSigningKeys(services.KeyPhaseRetiring, services.KeyPhaseActive, services.KeyPhaseRetiring); err != nil {
+		return trace.Wrap(err)
+	}
+	return trace.Wrap(s.CAService.UpsertCertAuthority(ca))
+}
+
+// scheduleNextPhase arranges for RotateCertAuthority to be called again
+// automatically once grace elapses, using the AuthServer's clock so
+// tests can drive rotation deterministically. A zero grace period, or a
+// rotation that has reached a terminal phase - completed normally
+// (RotationStandby) or aborted by an operator (RotationRollback) - does
+// not schedule anything further.
+func (s *AuthServer) scheduleNextPhase(caType services.CertAuthType, phase RotationPhase, grace time.Duration) error {
+	if grace <= 0 || phase == RotationStandby || phase == RotationRollback {
+		return nil
+	}
+	go func() {
+		<-s.clock.After(grace)
+		if err := s.RotateCertAuthority(caType, RotateRequest{GracePeriod: grace}); err != nil {
+			log.Warningf("[AUTH] automatic rotation of %v CA failed: %v", caType, err)
+		}
+	}()
+	return nil
+}